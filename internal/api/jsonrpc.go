@@ -0,0 +1,276 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// jsonrpcVersion is the only JSON-RPC version this codec understands
+const jsonrpcVersion = "2.0"
+
+// jsonrpcMethods maps JSON-RPC method names to the internal message types
+// they correspond to
+var jsonrpcMethods = map[string]MessageType{
+	"query":     TypeQuery,
+	"relogin":   TypeRelogin,
+	"subscribe": TypeSubscribe,
+}
+
+// jsonrpcRequest is a JSON-RPC 2.0 request or notification
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// jsonrpcError is a JSON-RPC 2.0 error object
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// jsonrpcResponse is a JSON-RPC 2.0 response or notification
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+}
+
+// jsonrpcConn wraps a client connection accepted on the JSON-RPC socket so
+// the reply written by the regular request handling code reaches the
+// client as a properly framed JSON-RPC 2.0 response instead of the custom
+// binary framing used on the default unix socket.
+//
+// Write is fed whatever bytes WriteMessage produces, in however many Write
+// calls it takes, which is not itself a JSON value and may be split across
+// calls. Rather than re-wrap those bytes directly, pipe them through
+// ReadMessage - the same decoder the binary framing already relies on - to
+// recover a real *Message, then build the JSON-RPC envelope from its
+// actual Type/Data instead of its wire representation
+type jsonrpcConn struct {
+	net.Conn
+	id           json.RawMessage
+	subscription bool
+
+	pw   *io.PipeWriter
+	done chan struct{}
+}
+
+// newJSONRPCConn wraps conn and starts translating messages written to it
+// into JSON-RPC 2.0 responses (or, for a subscription, notifications)
+func newJSONRPCConn(conn net.Conn, id json.RawMessage, subscription bool) *jsonrpcConn {
+	pr, pw := io.Pipe()
+	c := &jsonrpcConn{
+		Conn:         conn,
+		id:           id,
+		subscription: subscription,
+		pw:           pw,
+		done:         make(chan struct{}),
+	}
+	go c.relay(pr)
+	return c
+}
+
+// relay decodes messages written via Write with ReadMessage and re-encodes
+// each one as a JSON-RPC 2.0 response. For a one-shot query/relogin it
+// stops after the first reply; for a subscription it keeps translating
+// events until the pipe is closed
+func (c *jsonrpcConn) relay(pr *io.PipeReader) {
+	defer close(c.done)
+	for {
+		msg, err := ReadMessage(pr)
+		if err != nil {
+			return
+		}
+
+		resp := jsonrpcResponse{JSONRPC: jsonrpcVersion}
+		result := jsonRPCResult(msg.Data)
+		switch {
+		case msg.Type == TypeError:
+			// an error, e.g. an ACL rejection, can arrive even on a
+			// subscription connection if it is rejected before the
+			// subscription is accepted, so this takes priority over
+			// the c.subscription case below
+			resp.ID = c.id
+			resp.Error = &jsonrpcError{Code: -32000, Message: string(msg.Data)}
+		case c.subscription:
+			resp.Method = "notification"
+			resp.Result = result
+		default:
+			resp.ID = c.id
+			resp.Result = result
+		}
+
+		encoded, err := json.Marshal(resp)
+		if err != nil {
+			log.WithError(err).Error("Agent got error encoding JSON-RPC reply")
+			return
+		}
+		if _, err := c.Conn.Write(encoded); err != nil {
+			log.WithError(err).Error("Agent got JSON-RPC write error")
+			return
+		}
+
+		if !c.subscription {
+			return
+		}
+	}
+}
+
+// Write implements net.Conn by feeding b into the relay goroutine
+func (c *jsonrpcConn) Write(b []byte) (int, error) {
+	return c.pw.Write(b)
+}
+
+// Close closes the pipe to the relay goroutine, waits for it to finish
+// translating anything already written, and then closes the underlying
+// connection
+func (c *jsonrpcConn) Close() error {
+	_ = c.pw.Close()
+	<-c.done
+	return c.Conn.Close()
+}
+
+// jsonRPCResult turns a message payload into a JSON value for the result
+// field of a JSON-RPC response, which relay also uses for the payload of a
+// subscription notification: valid JSON is embedded as-is,
+// anything else is encoded as a JSON string so the envelope stays valid
+func jsonRPCResult(data []byte) json.RawMessage {
+	if len(data) == 0 {
+		return nil
+	}
+	if json.Valid(data) {
+		return data
+	}
+	encoded, err := json.Marshal(string(data))
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
+
+// GetUserJSONRPCSocketFile returns the JSON-RPC socket file for the current
+// user, next to the default unix socket used for the binary framing
+func GetUserJSONRPCSocketFile() string {
+	return GetUserSocketFile() + ".jsonrpc"
+}
+
+// handleJSONRPCClients handles client connections on the JSON-RPC socket
+func (s *Server) handleJSONRPCClients() {
+	defer func() {
+		_ = s.jsonrpcListen.Close()
+	}()
+	for {
+		conn, err := s.jsonrpcListen.Accept()
+		if err != nil {
+			if s.isStopping() {
+				return
+			}
+			log.WithError(err).Error("Agent got JSON-RPC listener error")
+			return
+		}
+
+		select {
+		case s.sem <- struct{}{}:
+		default:
+			resp := jsonrpcResponse{
+				JSONRPC: jsonrpcVersion,
+				Error:   &jsonrpcError{Code: -32000, Message: "server busy"},
+			}
+			if encoded, err := json.Marshal(resp); err == nil {
+				_, _ = conn.Write(encoded)
+			}
+			_ = conn.Close()
+			continue
+		}
+
+		s.wg.Add(1)
+		go s.handleJSONRPCRequest(conn)
+	}
+}
+
+// handleJSONRPCRequest decodes a single JSON-RPC 2.0 request from conn and
+// forwards it into the same request pipeline as the default unix socket via
+// dispatchRequest, so the ACL/read-only/TLS-CN checks and peer-identity
+// logging apply identically regardless of wire format
+func (s *Server) handleJSONRPCRequest(conn net.Conn) {
+	released := false
+	release := func() {
+		if released {
+			return
+		}
+		released = true
+		<-s.sem
+		s.wg.Done()
+	}
+	defer release()
+
+	var req jsonrpcRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		log.WithError(err).Error("Agent got JSON-RPC decode error")
+		_ = conn.Close()
+		return
+	}
+
+	typ, ok := jsonrpcMethods[req.Method]
+	if !ok {
+		resp := jsonrpcResponse{
+			JSONRPC: jsonrpcVersion,
+			ID:      req.ID,
+			Error:   &jsonrpcError{Code: -32601, Message: "method not found"},
+		}
+		if encoded, err := json.Marshal(resp); err == nil {
+			_, _ = conn.Write(encoded)
+		}
+		_ = conn.Close()
+		return
+	}
+
+	rpcConn := newJSONRPCConn(conn, req.ID, typ == TypeSubscribe)
+	msg := &Message{Type: typ, Data: req.Params}
+
+	s.dispatchRequest(rpcConn, ListenerConfig{Network: "unix", Address: GetUserJSONRPCSocketFile()}, msg, release)
+}
+
+// startJSONRPCListener starts the JSON-RPC listener next to the default
+// unix socket listener started in Start. If fd is a valid inherited file
+// descriptor handed off by a parent agent during a graceful restart, it is
+// used instead of rebinding the socket file
+func (s *Server) startJSONRPCListener(fd int, inherited bool) {
+	jsonrpcSockFile := GetUserJSONRPCSocketFile()
+
+	if inherited {
+		listen, err := net.FileListener(os.NewFile(uintptr(fd), jsonrpcSockFile))
+		if err != nil {
+			log.WithError(err).Error("Agent could not use inherited JSON-RPC listener")
+			return
+		}
+		s.jsonrpcListen = listen
+		go s.handleJSONRPCClients()
+		return
+	}
+
+	if err := os.Remove(jsonrpcSockFile); err == nil {
+		log.Warn("Removed existing JSON-RPC socket file")
+	}
+
+	listen, err := net.Listen("unix", jsonrpcSockFile)
+	if err != nil {
+		log.WithError(err).Error("Agent could not start JSON-RPC listener")
+		return
+	}
+	s.jsonrpcListen = listen
+
+	if err := os.Chmod(jsonrpcSockFile, 0700); err != nil {
+		log.WithError(err).Error("Agent could not set permissions of JSON-RPC socket file")
+	}
+
+	go s.handleJSONRPCClients()
+}
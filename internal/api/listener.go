@@ -0,0 +1,123 @@
+package api
+
+import (
+	"crypto/tls"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ListenerConfig configures an additional listener the API server accepts
+// client connections on, alongside the default unix socket
+type ListenerConfig struct {
+	// Network is the listener network, e.g. "unix" or "tcp"
+	Network string
+
+	// Address is the listener address, e.g. a socket path or "host:port"
+	Address string
+
+	// TLSConfig enables TLS on this listener when set. Set ClientAuth to
+	// tls.RequireAndVerifyClientCert for mutual TLS authentication
+	TLSConfig *tls.Config
+
+	// AllowedCNs restricts accepted clients to these certificate common
+	// names. Empty allows any certificate TLSConfig already verified
+	AllowedCNs []string
+
+	// ReadOnly restricts this listener to TypeQuery, so a remote
+	// monitoring host cannot trigger a TypeRelogin or TypeSubscribe
+	ReadOnly bool
+}
+
+// listener pairs a running net.Listener with the config it was started with
+type listener struct {
+	net.Listener
+	cfg ListenerConfig
+}
+
+// AddListener registers an additional listener, e.g. a TCP+mTLS listener
+// for remote monitoring, that Start binds and accepts connections on
+// alongside the default unix socket. It must be called before Start
+func (s *Server) AddListener(cfg ListenerConfig) {
+	s.listenerConfigs = append(s.listenerConfigs, cfg)
+}
+
+// startListener binds cfg and handles its client connections in its own
+// accept goroutine
+func (s *Server) startListener(cfg ListenerConfig) {
+	var l net.Listener
+	var err error
+	if cfg.TLSConfig != nil {
+		l, err = tls.Listen(cfg.Network, cfg.Address, cfg.TLSConfig)
+	} else {
+		l, err = net.Listen(cfg.Network, cfg.Address)
+	}
+	if err != nil {
+		log.WithError(err).WithField("address", cfg.Address).Error("Agent could not start listener")
+		return
+	}
+
+	sl := &listener{Listener: l, cfg: cfg}
+	s.listeners = append(s.listeners, sl)
+	go s.handleListenerClients(sl)
+}
+
+// handleListenerClients handles client connections accepted on l
+func (s *Server) handleListenerClients(l *listener) {
+	defer func() {
+		_ = l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isStopping() {
+				return
+			}
+			log.WithError(err).Error("Agent got listener error")
+			return
+		}
+
+		select {
+		case s.sem <- struct{}{}:
+		default:
+			e := NewError([]byte("server busy"))
+			if err := WriteMessage(conn, e); err != nil {
+				log.WithError(err).Error("Agent got message send error")
+			}
+			_ = conn.Close()
+			continue
+		}
+
+		s.wg.Add(1)
+		go s.handleRequest(conn, l.cfg)
+	}
+}
+
+// peerCommonName returns the verified client certificate's common name for
+// a TLS connection, or "" if conn is not a TLS connection with a verified
+// peer certificate
+func peerCommonName(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// allowedCN returns whether cn is allowed by cfg. An empty allow list
+// allows any certificate cfg.TLSConfig already verified
+func allowedCN(cfg ListenerConfig, cn string) bool {
+	if len(cfg.AllowedCNs) == 0 {
+		return true
+	}
+	for _, allowed := range cfg.AllowedCNs {
+		if allowed == cn {
+			return true
+		}
+	}
+	return false
+}
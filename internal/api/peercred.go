@@ -0,0 +1,22 @@
+package api
+
+// PeerCreds identifies the process on the other end of a client connection
+type PeerCreds struct {
+	PID int32
+	UID uint32
+	GID uint32
+	Exe string
+}
+
+// ACL maps a message type to a policy function deciding whether a caller
+// with the given peer credentials may send that message type. A message
+// type with no entry is allowed for every caller
+type ACL map[MessageType]func(PeerCreds) bool
+
+// SetACL sets the caller ACL policy enforced in dispatchRequest for every
+// request on any listener, including the JSON-RPC socket, e.g. to
+// restrict TypeRelogin to a specific binary path or gid while leaving
+// TypeQuery open to everyone. It must be called before Start
+func (s *Server) SetACL(acl ACL) {
+	s.acl = acl
+}
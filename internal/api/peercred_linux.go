@@ -0,0 +1,50 @@
+//go:build linux
+
+package api
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// getPeerCreds looks up the credentials of the process on the other end of
+// conn via SO_PEERCRED. It only works for unix domain socket connections
+func getPeerCreds(conn net.Conn) (PeerCreds, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return PeerCreds{}, fmt.Errorf("peer credentials require a unix socket connection")
+	}
+
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return PeerCreds{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return PeerCreds{}, err
+	}
+	if sockErr != nil {
+		return PeerCreds{}, sockErr
+	}
+
+	exe, err := os.Readlink("/proc/" + strconv.Itoa(int(ucred.Pid)) + "/exe")
+	if err != nil {
+		// process may have exited or /proc may be unavailable, still
+		// return the pid/uid/gid we already have
+		exe = ""
+	}
+
+	return PeerCreds{
+		PID: ucred.Pid,
+		UID: ucred.Uid,
+		GID: ucred.Gid,
+		Exe: exe,
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package api
+
+import (
+	"fmt"
+	"net"
+)
+
+// getPeerCreds is a stub for platforms other than Linux, which have no
+// SO_PEERCRED equivalent wired up here
+func getPeerCreds(_ net.Conn) (PeerCreds, error) {
+	return PeerCreds{}, fmt.Errorf("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// subscriberBuffer is the number of events buffered per subscriber before
+// events are dropped for a subscriber that is not keeping up
+const subscriberBuffer = 16
+
+// Event is a state change the agent publishes to subscribed clients, e.g. a
+// login state transition, a keep-alive result or a config reload
+type Event struct {
+	Data []byte
+}
+
+// addSubscriber registers conn as a subscriber and returns its event channel
+func (s *Server) addSubscriber(conn net.Conn) chan *Event {
+	events := make(chan *Event, subscriberBuffer)
+	s.subscribers.Store(conn, events)
+	return events
+}
+
+// removeSubscriber unregisters conn as a subscriber
+func (s *Server) removeSubscriber(conn net.Conn) {
+	s.subscribers.Delete(conn)
+}
+
+// Publish fans evt out to all currently subscribed clients. Subscribers that
+// are not keeping up have the event dropped instead of blocking the caller
+func (s *Server) Publish(evt *Event) {
+	s.subscribers.Range(func(key, value interface{}) bool {
+		events, ok := value.(chan *Event)
+		if !ok {
+			return true
+		}
+		select {
+		case events <- evt:
+		default:
+			log.Warn("Agent dropped event for slow subscriber")
+		}
+		return true
+	})
+}
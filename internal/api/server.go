@@ -1,10 +1,15 @@
 package api
 
 import (
+	"context"
 	"net"
 	"os"
+	"os/signal"
 	"os/user"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -14,13 +19,58 @@ const (
 	// serverTimeout is the timeout for an entire request/response exchange
 	// initiated by a client
 	serverTimeout = 30 * time.Second
+
+	// defaultHammerTimeout is the default value for Server.hammerTimeout,
+	// see SetHammerTimeout. It must stay >= serverTimeout: a client whose
+	// request is still legitimately within its serverTimeout deadline
+	// when Stop is called must not have its connection killed by the
+	// hammer timeout giving up first
+	defaultHammerTimeout = serverTimeout + 5*time.Second
+
+	// envListenFDs is the name of the environment variable used to pass
+	// the inherited listening sockets from a parent agent to a child
+	// agent during a graceful restart. Its value is a comma-separated
+	// list of "name:fd" pairs, e.g. "unix:3,jsonrpc:4"
+	envListenFDs = "FW_ID_AGENT_LISTEN_FDS"
+
+	// defaultMaxConcurrentRequests is the default value for
+	// Server.maxConcurrentRequests, see SetMaxConcurrentRequests
+	defaultMaxConcurrentRequests = 32
 )
 
 // Server is a Daemon API server
 type Server struct {
-	sockFile string
-	listen   net.Listener
-	requests chan *Request
+	sockFile      string
+	listen        net.Listener
+	jsonrpcListen net.Listener
+	requests      chan *Request
+	sem           chan struct{}
+
+	// listenerConfigs are additional listeners, e.g. a TCP+mTLS
+	// listener, registered with AddListener before Start
+	listenerConfigs []ListenerConfig
+	listeners       []*listener
+
+	// acl is the caller ACL policy set with SetACL
+	acl ACL
+
+	// hammerTimeout is how long Stop waits for in-flight handleRequest
+	// goroutines to drain before giving up on a graceful shutdown,
+	// see SetHammerTimeout
+	hammerTimeout time.Duration
+
+	// maxConcurrentRequests is the maximum number of client requests the
+	// server handles at the same time; clients above this limit are
+	// rejected with a "server busy" error instead of queuing up,
+	// see SetMaxConcurrentRequests
+	maxConcurrentRequests int
+
+	subscribers sync.Map // conn net.Conn -> chan *Event
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wg sync.WaitGroup
 
 	mutex sync.Mutex
 	stop  bool
@@ -42,9 +92,22 @@ func (s *Server) isStopping() bool {
 	return s.stop
 }
 
-// handleRequest handles a request from the client
-func (s *Server) handleRequest(conn net.Conn) {
-	// set timeout for entire request/response exchange
+// handleRequest handles a request from the client accepted on a listener
+// started with cfg
+func (s *Server) handleRequest(conn net.Conn, cfg ListenerConfig) {
+	released := false
+	release := func() {
+		if released {
+			return
+		}
+		released = true
+		<-s.sem
+		s.wg.Done()
+	}
+	defer release()
+
+	// set timeout for the initial request; subscriptions clear it again
+	// below since they are long-lived
 	deadline := time.Now().Add(serverTimeout)
 	if err := conn.SetDeadline(deadline); err != nil {
 		log.WithError(err).Error("Agent got error setting deadline")
@@ -64,6 +127,7 @@ func (s *Server) handleRequest(conn net.Conn) {
 	switch msg.Type {
 	case TypeQuery:
 	case TypeRelogin:
+	case TypeSubscribe:
 	default:
 		// send Error and disconnect
 		e := NewError([]byte("invalid message"))
@@ -71,12 +135,119 @@ func (s *Server) handleRequest(conn net.Conn) {
 			log.WithError(err).Error("Agent got message send error")
 		}
 		_ = conn.Close()
+		return
 	}
 
-	// forward client's request to agent
-	s.requests <- &Request{
-		msg:  msg,
-		conn: conn,
+	s.dispatchRequest(conn, cfg, msg, release)
+}
+
+// dispatchRequest identifies the caller, enforces cfg's ACL/read-only/TLS
+// common-name policy for msg, and then either starts a subscription or
+// forwards msg to the agent request queue. It is shared by handleRequest
+// and handleJSONRPCRequest so a request cannot bypass these checks by
+// going through one wire format instead of the other.
+//
+// release frees the concurrency slot msg's connection was accepted under;
+// it is called here immediately for a TypeSubscribe request, since
+// subscriptions are long-lived and must not pin the slot for as long as
+// the client stays connected, and otherwise left for the caller's deferred
+// release once this function returns
+func (s *Server) dispatchRequest(conn net.Conn, cfg ListenerConfig, msg *Message, release func()) {
+	// identify the caller for auditing and ACL enforcement; peer
+	// credentials are only available for unix socket connections. A
+	// JSON-RPC connection wraps the accepted socket, so look them up on
+	// the socket itself
+	credConn := conn
+	if rpcConn, ok := conn.(*jsonrpcConn); ok {
+		credConn = rpcConn.Conn
+	}
+	creds, err := getPeerCreds(credConn)
+	if err != nil {
+		log.WithError(err).Debug("Agent could not determine peer credentials")
+	}
+	log.WithFields(log.Fields{
+		"pid": creds.PID,
+		"uid": creds.UID,
+		"gid": creds.GID,
+		"exe": creds.Exe,
+	}).Debug("Agent got request from peer")
+
+	if policy, ok := s.acl[msg.Type]; ok && !policy(creds) {
+		log.WithField("exe", creds.Exe).Warn("Agent rejected request from peer not allowed by ACL")
+		e := NewError([]byte("unauthorized"))
+		if err := WriteMessage(conn, e); err != nil {
+			log.WithError(err).Error("Agent got message send error")
+		}
+		_ = conn.Close()
+		return
+	}
+
+	// a read-only listener, e.g. a TCP listener exposed for remote
+	// monitoring, may only be used to query the login state
+	if cfg.ReadOnly && msg.Type != TypeQuery {
+		e := NewError([]byte("listener is read-only"))
+		if err := WriteMessage(conn, e); err != nil {
+			log.WithError(err).Error("Agent got message send error")
+		}
+		_ = conn.Close()
+		return
+	}
+
+	// on a TLS listener, enforce the configured client certificate
+	// allow list before the request reaches the agent
+	if cfg.TLSConfig != nil {
+		cn := peerCommonName(conn)
+		if !allowedCN(cfg, cn) {
+			log.WithField("cn", cn).Warn("Agent rejected client with disallowed certificate")
+			e := NewError([]byte("unauthorized"))
+			if err := WriteMessage(conn, e); err != nil {
+				log.WithError(err).Error("Agent got message send error")
+			}
+			_ = conn.Close()
+			return
+		}
+		log.WithField("cn", cn).Debug("Agent authenticated TLS client")
+	}
+
+	if msg.Type == TypeSubscribe {
+		release()
+		s.handleSubscribe(conn)
+		return
+	}
+
+	// forward client's request to agent; give up if the server is
+	// stopping and cancels the context instead of blocking forever
+	select {
+	case s.requests <- &Request{
+		msg:   msg,
+		conn:  conn,
+		creds: creds,
+	}:
+	case <-s.ctx.Done():
+		_ = conn.Close()
+	}
+}
+
+// handleSubscribe turns conn into a long-lived subscription that receives
+// events published with Publish until the client disconnects
+func (s *Server) handleSubscribe(conn net.Conn) {
+	// subscriptions are long-lived, so the per-exchange deadline does
+	// not apply to them
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		log.WithError(err).Error("Agent got error clearing deadline")
+		_ = conn.Close()
+		return
+	}
+
+	events := s.addSubscriber(conn)
+	defer s.removeSubscriber(conn)
+
+	for evt := range events {
+		if err := WriteMessage(conn, NewEvent(evt.Data)); err != nil {
+			log.WithError(err).Error("Agent got event send error")
+			_ = conn.Close()
+			return
+		}
 	}
 }
 
@@ -84,7 +255,6 @@ func (s *Server) handleRequest(conn net.Conn) {
 func (s *Server) handleClients() {
 	defer func() {
 		_ = s.listen.Close()
-		close(s.requests)
 	}()
 	for {
 		// wait for new client connection
@@ -98,44 +268,217 @@ func (s *Server) handleClients() {
 			return
 		}
 
-		// read request from client connection and handle it
-		s.handleRequest(conn)
+		// reject the connection if we are already handling too many
+		// requests instead of letting it queue up indefinitely
+		select {
+		case s.sem <- struct{}{}:
+		default:
+			e := NewError([]byte("server busy"))
+			if err := WriteMessage(conn, e); err != nil {
+				log.WithError(err).Error("Agent got message send error")
+			}
+			_ = conn.Close()
+			continue
+		}
+
+		// handle the client connection in its own goroutine so a
+		// slow client cannot block every other client
+		s.wg.Add(1)
+		go s.handleRequest(conn, ListenerConfig{Network: "unix", Address: s.sockFile})
 	}
 }
 
-// Start starts the API server
-func (s *Server) Start() {
-	// cleanup existing sock file, this should normally fail
-	if err := os.Remove(s.sockFile); err == nil {
-		log.Warn("Removed existing unix socket file")
+// handleSignals waits for a SIGHUP or SIGUSR2 and triggers a graceful
+// restart of the server when it arrives
+func (s *Server) handleSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGUSR2)
+	for range sig {
+		log.Info("Agent got restart signal, handing off listening socket")
+		if err := s.restart(); err != nil {
+			log.WithError(err).Error("Agent could not restart")
+		}
+	}
+}
+
+// restart forks a copy of the running binary and hands it the already
+// listening unix sockets so it can take over without rebinding them, then
+// stops this server as soon as the child process has been started; it does
+// not wait for the child to report that it is serving.
+//
+// Only the default unix socket and the JSON-RPC unix socket are handed
+// off this way, since *net.UnixListener exposes the File method this
+// relies on. Listeners added with AddListener (e.g. a TCP+mTLS listener)
+// are not handed off: they are closed by the Stop call below and rebound
+// fresh by the child's Start, so connections on those listeners are
+// dropped across a restart
+func (s *Server) restart() error {
+	type handoff struct {
+		name string
+		file *os.File
+	}
+	var handoffs []handoff
+
+	unixListen := s.listen.(*net.UnixListener)
+	unixFile, err := unixListen.File()
+	if err != nil {
+		return err
+	}
+	// the child now listens on this socket file, so closing our copy of
+	// the listener in Stop must not unlink it
+	unixListen.SetUnlinkOnClose(false)
+	defer func() { _ = unixFile.Close() }()
+	handoffs = append(handoffs, handoff{"unix", unixFile})
+
+	if jsonrpcListen, ok := s.jsonrpcListen.(*net.UnixListener); ok {
+		jsonrpcFile, err := jsonrpcListen.File()
+		if err != nil {
+			log.WithError(err).Error("Agent could not hand off JSON-RPC listener, it will be rebound by the child")
+		} else {
+			jsonrpcListen.SetUnlinkOnClose(false)
+			defer func() { _ = jsonrpcFile.Close() }()
+			handoffs = append(handoffs, handoff{"jsonrpc", jsonrpcFile})
+		}
 	}
 
-	// start listener
-	listen, err := net.Listen("unix", s.sockFile)
+	if len(s.listenerConfigs) > 0 {
+		log.Warn("Agent cannot hand off TCP/TLS listeners across a restart, they will be rebound by the child")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	names := make([]string, 0, len(handoffs))
+	for _, h := range handoffs {
+		names = append(names, h.name+":"+strconv.Itoa(len(files)))
+		files = append(files, h.file)
+	}
+
+	env := append(os.Environ(), envListenFDs+"="+strings.Join(names, ","))
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: files,
+	})
 	if err != nil {
-		log.WithError(err).Fatal("Agent could not start unix listener")
+		return err
+	}
+	log.WithField("pid", proc.Pid).Info("Agent started child for graceful restart")
+
+	s.Stop()
+	return nil
+}
+
+// parseListenFDs parses the envListenFDs environment variable into a map
+// of listener name to inherited file descriptor
+func parseListenFDs(val string) map[string]int {
+	fds := map[string]int{}
+	if val == "" {
+		return fds
+	}
+	for _, pair := range strings.Split(val, ",") {
+		name, fdStr, ok := strings.Cut(pair, ":")
+		if !ok {
+			continue
+		}
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			continue
+		}
+		fds[name] = fd
 	}
-	s.listen = listen
+	return fds
+}
+
+// Start starts the API server
+func (s *Server) Start() {
+	inherited := parseListenFDs(os.Getenv(envListenFDs))
+	_ = os.Unsetenv(envListenFDs)
+
+	if fd, ok := inherited["unix"]; ok {
+		// inherited an already listening socket from a parent agent
+		// that is handing off for a graceful restart, use it instead
+		// of binding sockFile again to avoid the os.Remove race
+		listen, err := net.FileListener(os.NewFile(uintptr(fd), s.sockFile))
+		if err != nil {
+			log.WithError(err).Fatal("Agent could not use inherited unix listener")
+		}
+		s.listen = listen
+	} else {
+		// cleanup existing sock file, this should normally fail
+		if err := os.Remove(s.sockFile); err == nil {
+			log.Warn("Removed existing unix socket file")
+		}
 
-	// make sure only the current user can access the sock file
-	if err := os.Chmod(s.sockFile, 0700); err != nil {
-		log.WithError(err).Error("Agent could not set permissions of socket file")
+		// start listener
+		listen, err := net.Listen("unix", s.sockFile)
+		if err != nil {
+			log.WithError(err).Fatal("Agent could not start unix listener")
+		}
+		s.listen = listen
+
+		// make sure only the current user can access the sock file
+		if err := os.Chmod(s.sockFile, 0700); err != nil {
+			log.WithError(err).Error("Agent could not set permissions of socket file")
+		}
 	}
 
-	// handle client connections
+	// handle client connections and graceful-restart signals
 	go s.handleClients()
+	go s.handleSignals()
+
+	// start the JSON-RPC listener alongside the default unix socket so
+	// clients that prefer JSON-RPC 2.0 framing don't need the binary
+	// header, or pick up the one inherited from a parent agent
+	jsonrpcFD, hasJSONRPCFD := inherited["jsonrpc"]
+	s.startJSONRPCListener(jsonrpcFD, hasJSONRPCFD)
+
+	// start any additional listeners, e.g. a TCP+mTLS listener for
+	// remote monitoring, registered with AddListener
+	for _, cfg := range s.listenerConfigs {
+		s.startListener(cfg)
+	}
 }
 
 // Stop stops the API server
 func (s *Server) Stop() {
-	// stop listener
+	// stop listeners
 	s.setStopping()
 	err := s.listen.Close()
 	if err != nil {
 		log.WithError(err).Fatal("Agent could not close unix listener")
 	}
-	for range s.requests {
-		// wait for clients channel close
+	if s.jsonrpcListen != nil {
+		if err := s.jsonrpcListen.Close(); err != nil {
+			log.WithError(err).Error("Agent could not close JSON-RPC listener")
+		}
+	}
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil {
+			log.WithError(err).Error("Agent could not close listener")
+		}
+	}
+
+	// unblock any goroutine stuck forwarding a request to the agent
+	s.cancel()
+
+	// wait for in-flight requests to drain, but do not block Stop's
+	// caller forever. s.requests is only closed once wg.Wait() actually
+	// returns, never on the hammerTimeout branch below, so a handleRequest
+	// goroutine still running past the timeout can never race a send
+	// against a closed channel
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(s.requests)
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(s.hammerTimeout):
+		log.Warn("Agent gave up waiting for in-flight requests to drain; requests channel will close once they finish")
 	}
 }
 
@@ -146,12 +489,31 @@ func (s *Server) Requests() chan *Request {
 
 // NewServer returns a new API server
 func NewServer(sockFile string) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
-		sockFile: sockFile,
-		requests: make(chan *Request),
+		sockFile:              sockFile,
+		requests:              make(chan *Request),
+		sem:                   make(chan struct{}, defaultMaxConcurrentRequests),
+		ctx:                   ctx,
+		cancel:                cancel,
+		hammerTimeout:         defaultHammerTimeout,
+		maxConcurrentRequests: defaultMaxConcurrentRequests,
 	}
 }
 
+// SetHammerTimeout overrides how long Stop waits for in-flight requests to
+// drain before giving up on a graceful shutdown or restart
+func (s *Server) SetHammerTimeout(d time.Duration) {
+	s.hammerTimeout = d
+}
+
+// SetMaxConcurrentRequests overrides the maximum number of client requests
+// handled at the same time. It must be called before Start
+func (s *Server) SetMaxConcurrentRequests(n int) {
+	s.maxConcurrentRequests = n
+	s.sem = make(chan struct{}, n)
+}
+
 // GetUserSocketFile returns the socket file for the current user
 func GetUserSocketFile() string {
 	user, err := user.Current()
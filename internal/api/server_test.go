@@ -0,0 +1,210 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestUnixServer starts an api server listening on a temporary unix
+// socket through the real handleClients accept loop, exactly like Start
+// does for the default socket, without pulling in Start's signal handling
+// or its fixed, user-derived socket paths
+func newTestUnixServer(t *testing.T) (*Server, string) {
+	t.Helper()
+
+	sockFile := filepath.Join(t.TempDir(), "test.sock")
+	s := NewServer(sockFile)
+
+	listen, err := net.Listen("unix", sockFile)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s.listen = listen
+	go s.handleClients()
+
+	t.Cleanup(s.Stop)
+
+	return s, sockFile
+}
+
+// waitForSemSize polls until the server's concurrency semaphore holds
+// exactly n acquired slots, so a test can be sure the accept loop has
+// actually taken a slot for a prior connection before driving the next
+// connection
+func waitForSemSize(t *testing.T, s *Server, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if len(s.sem) == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("semaphore never reached size %d, got %d", n, len(s.sem))
+}
+
+// TestACLRejectsUnauthorizedRequest drives a real client connection through
+// the accept path and checks a request denied by the ACL is rejected with
+// an "unauthorized" error instead of ever reaching the agent
+func TestACLRejectsUnauthorizedRequest(t *testing.T) {
+	s, sockFile := newTestUnixServer(t)
+	s.SetACL(ACL{
+		TypeRelogin: func(PeerCreds) bool { return false },
+	})
+
+	conn, err := net.Dial("unix", sockFile)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := WriteMessage(conn, &Message{Type: TypeRelogin}); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+
+	reply, err := ReadMessage(conn)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if reply.Type != TypeError || string(reply.Data) != "unauthorized" {
+		t.Errorf("got %+v, want an unauthorized error", reply)
+	}
+}
+
+// TestMaxConcurrentRequestsRejectsOverCapacity drives two real client
+// connections through the accept path with maxConcurrentRequests set to 1
+// and checks the second one is rejected with a "server busy" error while
+// the first is still being handled
+func TestMaxConcurrentRequestsRejectsOverCapacity(t *testing.T) {
+	s, sockFile := newTestUnixServer(t)
+	s.SetMaxConcurrentRequests(1)
+
+	first, err := net.Dial("unix", sockFile)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer first.Close()
+	waitForSemSize(t, s, 1)
+
+	second, err := net.Dial("unix", sockFile)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer second.Close()
+
+	reply, err := ReadMessage(second)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if reply.Type != TypeError || string(reply.Data) != "server busy" {
+		t.Errorf("got %+v, want a server busy error", reply)
+	}
+}
+
+// TestReadOnlyListenerRejectsRelogin drives real client connections through
+// a read-only listener's accept path and checks TypeRelogin is rejected
+// while TypeQuery still reaches the agent
+func TestReadOnlyListenerRejectsRelogin(t *testing.T) {
+	s, _ := newTestUnixServer(t)
+
+	roSockFile := filepath.Join(t.TempDir(), "readonly.sock")
+	s.startListener(ListenerConfig{Network: "unix", Address: roSockFile, ReadOnly: true})
+
+	conn, err := net.Dial("unix", roSockFile)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := WriteMessage(conn, &Message{Type: TypeRelogin}); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	reply, err := ReadMessage(conn)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if reply.Type != TypeError || string(reply.Data) != "listener is read-only" {
+		t.Errorf("got %+v, want a read-only error", reply)
+	}
+
+	query, err := net.Dial("unix", roSockFile)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer query.Close()
+	if err := WriteMessage(query, &Message{Type: TypeQuery}); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+
+	select {
+	case req := <-s.Requests():
+		if req.msg.Type != TypeQuery {
+			t.Errorf("got message type %v, want TypeQuery", req.msg.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TypeQuery was never forwarded to the agent")
+	}
+}
+
+// TestJSONRPCEnforcesACL drives a real client connection through the
+// JSON-RPC accept path and checks a request denied by the ACL is rejected
+// with a JSON-RPC error instead of reaching the agent, exactly like the
+// same request would be rejected on the default unix socket
+func TestJSONRPCEnforcesACL(t *testing.T) {
+	s, _ := newTestUnixServer(t)
+	s.SetACL(ACL{
+		TypeRelogin: func(PeerCreds) bool { return false },
+	})
+
+	jsonrpcSockFile := filepath.Join(t.TempDir(), "test.jsonrpc")
+	listen, err := net.Listen("unix", jsonrpcSockFile)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s.jsonrpcListen = listen
+	go s.handleJSONRPCClients()
+
+	conn, err := net.Dial("unix", jsonrpcSockFile)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(`{"jsonrpc":"2.0","method":"relogin","id":1}`)); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+
+	var resp jsonrpcResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if resp.Error == nil {
+		t.Fatalf("got %+v, want a JSON-RPC error rejecting the unauthorized request", resp)
+	}
+
+	select {
+	case req := <-s.Requests():
+		t.Fatalf("unauthorized request %+v reached the agent", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestAllowedCN checks the TLS listener's client certificate allow list
+func TestAllowedCN(t *testing.T) {
+	cfg := ListenerConfig{}
+	if !allowedCN(cfg, "anything") {
+		t.Error("an empty allow list must allow any certificate")
+	}
+
+	cfg.AllowedCNs = []string{"monitor.example.com"}
+	if allowedCN(cfg, "other") {
+		t.Error("a disallowed CN must be rejected")
+	}
+	if !allowedCN(cfg, "monitor.example.com") {
+		t.Error("an allowed CN must be accepted")
+	}
+}